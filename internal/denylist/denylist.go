@@ -0,0 +1,251 @@
+package denylist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind of denylist entry
+type Kind string
+
+const (
+	// KindDomain blocks a domain and all its subdomains
+	KindDomain Kind = "domain"
+	// KindID blocks a source video ID for an extractor, value is "extractor:id"
+	KindID Kind = "id"
+	// KindExtractor blocks a youtube-dl extractor
+	KindExtractor Kind = "extractor"
+)
+
+// Entry denylist entry, empty countries means all countries
+type Entry struct {
+	Kind      Kind
+	Value     string
+	Countries []string
+}
+
+func (e Entry) appliesTo(country string) bool {
+	if len(e.Countries) == 0 {
+		return true
+	}
+	for _, c := range e.Countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse denylist from reader
+// One entry per line "kind value [COUNTRY,COUNTRY...]", # starts a comment
+func Parse(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	s := bufio.NewScanner(r)
+	lineNr := 0
+	for s.Scan() {
+		lineNr++
+		line := s.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[0:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: too many fields", lineNr)
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected kind and value", lineNr)
+		}
+
+		e := Entry{Kind: Kind(strings.ToLower(fields[0])), Value: fields[1]}
+		switch e.Kind {
+		case KindDomain:
+			e.Value = strings.ToLower(strings.TrimSuffix(e.Value, "."))
+		case KindID:
+			i := strings.LastIndex(e.Value, ":")
+			if i <= 0 || i == len(e.Value)-1 {
+				return nil, fmt.Errorf("line %d: id must be extractor:id", lineNr)
+			}
+			e.Value = strings.ToLower(e.Value[0:i]) + e.Value[i:]
+		case KindExtractor:
+			e.Value = strings.ToLower(e.Value)
+		default:
+			return nil, fmt.Errorf("line %d: unknown kind %s", lineNr, fields[0])
+		}
+		if len(fields) == 3 {
+			e.Countries = strings.Split(fields[2], ",")
+		}
+
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// Error returned when something is blocked
+type Error struct {
+	Entry Entry
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("blocked by %s denylist: %s", e.Entry.Kind, e.Entry.Value)
+}
+
+// Denylist entries loaded from a file path or http(s) URL and reloaded
+// in background every refresh interval
+type Denylist struct {
+	Source          string
+	Country         string
+	RefreshInterval time.Duration
+	Client          *http.Client
+	Log             *log.Logger
+
+	mutex   sync.Mutex
+	entries []Entry
+	stopCh  chan struct{}
+}
+
+// New denylist, does an initial load from source and starts background
+// reload if refresh interval is not zero. Reload failures are logged to log
+// if not nil.
+func New(source string, country string, refreshInterval time.Duration, log *log.Logger) (*Denylist, error) {
+	dl := &Denylist{
+		Source:          source,
+		Country:         country,
+		RefreshInterval: refreshInterval,
+		Log:             log,
+		stopCh:          make(chan struct{}),
+	}
+	if err := dl.Reload(); err != nil {
+		return nil, err
+	}
+	if refreshInterval > 0 {
+		go dl.reloadLoop(refreshInterval)
+	}
+
+	return dl, nil
+}
+
+// a failed reload is logged and retried next interval
+func (dl *Denylist) reloadLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := dl.Reload(); err != nil && dl.Log != nil {
+				dl.Log.Printf("denylist reload failed, keeping current entries: %s", err)
+			}
+		case <-dl.stopCh:
+			return
+		}
+	}
+}
+
+// Close stops background reload
+func (dl *Denylist) Close() {
+	close(dl.stopCh)
+}
+
+func (dl *Denylist) open() (io.ReadCloser, error) {
+	if !strings.HasPrefix(dl.Source, "http://") && !strings.HasPrefix(dl.Source, "https://") {
+		return os.Open(dl.Source)
+	}
+
+	client := dl.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Get(dl.Source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", dl.Source, resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// Reload entries from source, keeps current entries on error
+func (dl *Denylist) Reload() error {
+	r, err := dl.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	entries, err := Parse(r)
+	if err != nil {
+		return fmt.Errorf("%s: %s", dl.Source, err)
+	}
+
+	dl.mutex.Lock()
+	dl.entries = entries
+	dl.mutex.Unlock()
+
+	return nil
+}
+
+func (dl *Denylist) current() []Entry {
+	dl.mutex.Lock()
+	defer dl.mutex.Unlock()
+	return dl.entries
+}
+
+func domainMatch(host string, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func (dl *Denylist) check(kind Kind, fn func(e Entry) bool) error {
+	for _, e := range dl.current() {
+		if e.Kind == kind && e.appliesTo(dl.Country) && fn(e) {
+			return Error{Entry: e}
+		}
+	}
+	return nil
+}
+
+// CheckURL returns Error if URL host is blocked
+func (dl *Denylist) CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+
+	return dl.check(KindDomain, func(e Entry) bool { return domainMatch(host, e.Value) })
+}
+
+// CheckID returns Error if source video ID is blocked for extractor
+func (dl *Denylist) CheckID(extractor string, id string) error {
+	if extractor == "" || id == "" {
+		return nil
+	}
+	value := strings.ToLower(extractor) + ":" + id
+
+	return dl.check(KindID, func(e Entry) bool { return e.Value == value })
+}
+
+// CheckExtractor returns Error if youtube-dl extractor is blocked
+func (dl *Denylist) CheckExtractor(extractor string) error {
+	if extractor == "" {
+		return nil
+	}
+
+	return dl.check(KindExtractor, func(e Entry) bool { return strings.EqualFold(e.Value, extractor) })
+}
@@ -0,0 +1,139 @@
+package denylist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	entries, err := Parse(strings.NewReader(`
+# comment
+domain Example.COM.
+id YouTube:abc123 # trailing comment
+domain other.org DE,AT
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Entry{
+		{Kind: KindDomain, Value: "example.com"},
+		{Kind: KindID, Value: "youtube:abc123"},
+		{Kind: KindDomain, Value: "other.org", Countries: []string{"DE", "AT"}},
+	}
+	if fmt.Sprintf("%v", entries) != fmt.Sprintf("%v", expected) {
+		t.Errorf("got %v expected %v", entries, expected)
+	}
+
+	for _, s := range []string{"domain", "nope a.com", "domain a.com DE extra", "id abc123", "id :abc123", "id youtube:"} {
+		if _, err := Parse(strings.NewReader(s)); err == nil {
+			t.Errorf("%s, expected error", s)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	f, err := ioutil.TempFile("", "denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("domain example.com\nid youtube:abc123\ndomain other.org DE\nextractor Vimeo\n")
+	f.Close()
+
+	for _, c := range []struct {
+		country   string
+		url       string
+		id        string
+		extractor string
+		blocked   bool
+	}{
+		{"", "https://example.com/a", "", "", true},
+		{"", "https://www.EXAMPLE.com/a", "", "", true},
+		{"", "https://notexample.com/a", "", "", false},
+		{"", "https://host/a", "abc123", "youtube", true},
+		{"", "https://host/a", "abc123", "YouTube", true},
+		{"", "https://host/a", "abc1234", "youtube", false},
+		{"", "https://host/a", "abc123", "dailymotion", false},
+		{"", "https://other.org/a", "", "", false},
+		{"de", "https://other.org/a", "", "", true},
+		{"SE", "https://other.org/a", "", "", false},
+		{"", "https://host/a", "", "vimeo", true},
+		{"", "https://host/a", "", "youtube", false},
+	} {
+		dl, err := New(f.Name(), c.country, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = dl.CheckURL(c.url)
+		if err == nil {
+			err = dl.CheckID(c.extractor, c.id)
+		}
+		if err == nil {
+			err = dl.CheckExtractor(c.extractor)
+		}
+		if _, ok := err.(Error); ok != c.blocked {
+			t.Errorf("%+v, got %v expected blocked %v", c, err, c.blocked)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var listMutex sync.Mutex
+	list := "domain a.com\n"
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		listMutex.Lock()
+		defer listMutex.Unlock()
+		if fail {
+			http.Error(w, "fail", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(list))
+	}))
+	defer ts.Close()
+
+	dl, err := New(ts.URL, "", 5*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dl.Close()
+	if err := dl.CheckURL("http://a.com"); err == nil {
+		t.Error("expected a.com to be blocked")
+	}
+
+	waitFor := func(fn func() bool) bool {
+		for i := 0; i < 100; i++ {
+			if fn() {
+				return true
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return false
+	}
+
+	listMutex.Lock()
+	list = "domain b.com\n"
+	listMutex.Unlock()
+	if !waitFor(func() bool { return dl.CheckURL("http://b.com") != nil }) {
+		t.Error("expected b.com to be blocked after reload")
+	}
+	if err := dl.CheckURL("http://a.com"); err != nil {
+		t.Errorf("expected a.com to not be blocked, got %v", err)
+	}
+
+	listMutex.Lock()
+	fail = true
+	listMutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	if err := dl.CheckURL("http://b.com"); err == nil {
+		t.Error("expected b.com to still be blocked after failed reload")
+	}
+}
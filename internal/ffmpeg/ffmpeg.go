@@ -1,6 +1,7 @@
 package ffmpeg
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -295,6 +296,71 @@ func Probe(ctx context.Context, i Input, debugLog *log.Logger, stderr io.Writer)
 	return pi, nil
 }
 
+// parse "ffmpeg -codecs" output, codecs with encoding support and their encoders
+func parseEncoders(r io.Reader) (map[string]bool, error) {
+	encoders := map[string]bool{}
+
+	s := bufio.NewScanner(r)
+	listStarted := false
+	for s.Scan() {
+		line := s.Text()
+		if !listStarted {
+			listStarted = strings.HasPrefix(strings.TrimSpace(line), "---")
+			continue
+		}
+
+		// " DEA.L. name  description (decoders: a b ) (encoders: c d )"
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields[0]) < 2 || fields[0][1] != 'E' {
+			continue
+		}
+		encoders[fields[1]] = true
+
+		const encodersPrefix = "(encoders: "
+		if i := strings.Index(line, encodersPrefix); i != -1 {
+			rest := line[i+len(encodersPrefix):]
+			if j := strings.Index(rest, ")"); j != -1 {
+				rest = rest[0:j]
+			}
+			for _, e := range strings.Fields(rest) {
+				encoders[e] = true
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if !listStarted {
+		return nil, fmt.Errorf("could not find codecs list")
+	}
+
+	return encoders, nil
+}
+
+// Encoders names of codecs and encoders ffmpeg can encode with
+func Encoders(ctx context.Context) (map[string]bool, error) {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-codecs")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	encoders, parseErr := parseEncoders(stdout)
+	// drain in case parse stopped early
+	io.Copy(ioutil.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	return encoders, nil
+}
+
 func (m Metadata) Map() map[string]string {
 	kv := map[string]string{}
 	t := reflect.TypeOf(m)
@@ -10,6 +10,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,6 +19,59 @@ import (
 
 var testFfmpeg = os.Getenv("TEST_FFMPEG") != ""
 
+func TestParseEncoders(t *testing.T) {
+	encoders, err := parseEncoders(strings.NewReader(`Codecs:
+ D..... = Decoding supported
+ .E.... = Encoding supported
+ -------
+ D.VI.S 012v                 Uncompressed 4:2:2 10-bit
+ DEV.LS h264                 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (decoders: h264 h264_v4l2m2m ) (encoders: libx264 h264_nvenc )
+ DEA.L. mp3                  MP3 (MPEG audio layer 3) (decoders: mp3float mp3 ) (encoders: libmp3lame )
+ DEAI.S flac                 FLAC (Free Lossless Audio Codec)
+ D.A.L. cook                 Cook / Cooker / Gecko (RealAudio G2)
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name     string
+		expected bool
+	}{
+		{"h264", true},
+		{"libx264", true},
+		{"h264_nvenc", true},
+		{"h264_v4l2m2m", false},
+		{"mp3", true},
+		{"libmp3lame", true},
+		{"flac", true},
+		{"cook", false},
+		{"012v", false},
+	} {
+		if encoders[c.name] != c.expected {
+			t.Errorf("%s, expected %v", c.name, c.expected)
+		}
+	}
+
+	if _, err := parseEncoders(strings.NewReader("nope")); err == nil {
+		t.Error("expected error for output without codecs list")
+	}
+}
+
+func TestEncoders(t *testing.T) {
+	if !testFfmpeg {
+		t.Skip("TEST_FFMPEG env not set")
+	}
+
+	encoders, err := Encoders(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !encoders["pcm_s16le"] {
+		t.Error("expected pcm_s16le encoder")
+	}
+}
+
 func TestDurationToPosition(t *testing.T) {
 	for _, tc := range []struct {
 		duration time.Duration
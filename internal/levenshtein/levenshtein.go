@@ -0,0 +1,44 @@
+package levenshtein
+
+// Distance number of single rune insertions, deletions or substitutions
+// needed to change a into b
+func Distance(a string, b string) int {
+	ra := []rune(a)
+	rb := []rune(b)
+
+	// previous and current row of the edit distance matrix
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(
+				prev[j]+1,
+				cur[j-1]+1,
+				prev[j-1]+cost,
+			)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func min3(a int, b int, c int) int {
+	m := a
+	if b < m {
+		m = b
+	}
+	if c < m {
+		m = c
+	}
+	return m
+}
@@ -0,0 +1,29 @@
+package levenshtein
+
+import "testing"
+
+func TestDistance(t *testing.T) {
+	for _, c := range []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"", "", 0},
+		{"a", "", 1},
+		{"", "abc", 3},
+		{"mp3", "mp3", 0},
+		{"mp3", "mp4", 1},
+		{"mp3", "m4a", 2},
+		{"webm", "wbem", 2},
+		{"kitten", "sitting", 3},
+		{"flac", "alac", 1},
+		{"åäö", "aäo", 2},
+	} {
+		for _, ab := range [][2]string{{c.a, c.b}, {c.b, c.a}} {
+			actual := Distance(ab[0], ab[1])
+			if actual != c.expected {
+				t.Errorf("%s %s, got %d expected %d", ab[0], ab[1], actual, c.expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package spool
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// Spool reads all data from a source into a temporary file as fast as
+// possible while data is read back at the pace of the reader. Useful to
+// decouple a producer that should not be throttled from a slow consumer.
+// When max size is reached spooling stops and after spooled data has been
+// read, reads go directly to the source.
+type Spool struct {
+	src     io.ReadCloser
+	maxSize int64
+	w       *os.File
+	r       *os.File
+	doneCh  chan struct{}
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	written int64
+	read    int64
+	done    bool
+	full    bool
+	err     error
+}
+
+// New spool from src using temporary file in dir, empty dir uses default
+// temporary directory. Zero maxSize is unlimited. Starts reading from src directly.
+func New(dir string, src io.ReadCloser, maxSize int64) (*Spool, error) {
+	w, err := ioutil.TempFile(dir, "ydls-spool")
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+
+	s := &Spool{
+		src:     src,
+		maxSize: maxSize,
+		w:       w,
+		r:       r,
+		doneCh:  make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mutex)
+
+	go s.fill()
+
+	return s, nil
+}
+
+func (s *Spool) fill() {
+	defer close(s.doneCh)
+
+	buf := make([]byte, 32*1024)
+	for {
+		if s.maxSize > 0 && s.Written() >= s.maxSize {
+			s.mutex.Lock()
+			s.full = true
+			s.cond.Broadcast()
+			s.mutex.Unlock()
+			return
+		}
+
+		n, err := s.src.Read(buf)
+		if n > 0 {
+			if _, wErr := s.w.Write(buf[0:n]); wErr != nil {
+				err = wErr
+			} else {
+				s.mutex.Lock()
+				s.written += int64(n)
+				s.cond.Broadcast()
+				s.mutex.Unlock()
+			}
+		}
+		if err != nil {
+			s.mutex.Lock()
+			s.done = true
+			if err != io.EOF {
+				s.err = err
+			}
+			s.cond.Broadcast()
+			s.mutex.Unlock()
+			return
+		}
+	}
+}
+
+// Read spooled data, blocks until more data is available or source is done
+func (s *Spool) Read(p []byte) (n int, err error) {
+	s.mutex.Lock()
+	for s.read == s.written && !s.done && !s.full {
+		s.cond.Wait()
+	}
+	if s.read == s.written && s.full {
+		// spooling has stopped so safe to read source directly
+		s.mutex.Unlock()
+		return s.src.Read(p)
+	}
+	if s.read == s.written {
+		err := s.err
+		s.mutex.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	available := s.written - s.read
+	offset := s.read
+	s.mutex.Unlock()
+
+	if int64(len(p)) > available {
+		p = p[0:available]
+	}
+	n, err = s.r.ReadAt(p, offset)
+
+	s.mutex.Lock()
+	s.read += int64(n)
+	s.mutex.Unlock()
+
+	// a short read at current end of file is not end of spool
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+
+	return n, err
+}
+
+// Written number of bytes spooled so far
+func (s *Spool) Written() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.written
+}
+
+// Close source, wait for spooling to stop and remove temporary file
+func (s *Spool) Close() error {
+	s.src.Close()
+	<-s.doneCh
+	s.r.Close()
+	s.w.Close()
+	return os.Remove(s.w.Name())
+}
@@ -0,0 +1,134 @@
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadAll(t *testing.T) {
+	data := bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7}, 100000)
+	pr, pw := io.Pipe()
+
+	s, err := New("", pr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		// write in chunks so reader will catch up with writer
+		for i := 0; i < len(data); i += 1000 {
+			pw.Write(data[i : i+1000])
+		}
+		pw.Close()
+	}()
+
+	actual, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, data) {
+		t.Errorf("got %d bytes, expected %d bytes", len(actual), len(data))
+	}
+	if s.Written() != int64(len(data)) {
+		t.Errorf("expected written %d, got %d", len(data), s.Written())
+	}
+
+	name := s.w.Name()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected spool file to be removed, got %v", err)
+	}
+}
+
+func TestSourceDrainedWithoutReader(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 1000000)
+	pr, pw := io.Pipe()
+
+	s, err := New("", pr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// would block if nothing consumed the pipe
+	if _, err := pw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+	<-s.doneCh
+
+	if s.Written() != int64(len(data)) {
+		t.Errorf("expected written %d, got %d", len(data), s.Written())
+	}
+}
+
+func TestSourceError(t *testing.T) {
+	pr, pw := io.Pipe()
+	s, err := New("", pr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testErr := errors.New("test")
+	pw.Write([]byte{1, 2})
+	pw.CloseWithError(testErr)
+
+	actual, err := ioutil.ReadAll(s)
+	if err != testErr {
+		t.Errorf("expected test error, got %v", err)
+	}
+	if !bytes.Equal(actual, []byte{1, 2}) {
+		t.Errorf("expected buffered data, got %v", actual)
+	}
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	pr, _ := io.Pipe()
+	s, err := New("", pr, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readErrCh := make(chan error)
+	go func() {
+		_, err := s.Read(make([]byte, 1))
+		readErrCh <- err
+	}()
+
+	s.Close()
+	if err := <-readErrCh; err == nil {
+		t.Error("expected read error after close")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	data := bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6, 7}, 100000)
+	const maxSize = 100000
+
+	s, err := New("", ioutil.NopCloser(bytes.NewReader(data)), maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	<-s.doneCh
+	// might spool one buffer more than max size
+	if s.Written() < maxSize || s.Written() > maxSize+32*1024 {
+		t.Errorf("expected about %d spooled, got %d", maxSize, s.Written())
+	}
+
+	actual, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, data) {
+		t.Errorf("got %d bytes, expected %d bytes", len(actual), len(data))
+	}
+}
@@ -19,6 +19,11 @@ func NewFromString(s string) (TimeRange, error) {
 	return parseDurationRange(s)
 }
 
+// ParseDuration parse duration from N seconds or NhNmNs string
+func ParseDuration(s string) (time.Duration, error) {
+	return parseDuration(s)
+}
+
 // N or NhNmNs
 var parseDurationReN = regexp.MustCompile(`^\d+$`)
 var parseDurationReMix = regexp.MustCompile(`^(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s)?$`)
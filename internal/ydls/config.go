@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/url"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/wader/ydls/internal/levenshtein"
 	"github.com/wader/ydls/internal/stringprioset"
 )
 
@@ -14,6 +18,184 @@ type Config struct {
 	InputFlags []string
 	CodecMap   map[string]string
 	Formats    Formats
+	Compliance ComplianceConfig
+	Spool      SpoolConfig
+	Prepare    PrepareConfig
+	Federation FederationConfig
+}
+
+// FederationConfig forward requests to peer ydls instances
+type FederationConfig struct {
+	Secret         string
+	MaxDownloads   int
+	PeerOnly       bool
+	HealthInterval string
+	Peers          []PeerConfig
+
+	healthInterval time.Duration
+}
+
+const defaultFederationHealthInterval = 30 * time.Second
+
+func (fc *FederationConfig) UnmarshalJSON(b []byte) (err error) {
+	type FederationConfigRaw FederationConfig
+	var fcr FederationConfigRaw
+	if err := json.Unmarshal(b, &fcr); err != nil {
+		return err
+	}
+	*fc = FederationConfig(fcr)
+
+	if fc.Secret == "" {
+		return fmt.Errorf("federation secret can't be empty")
+	}
+	fc.healthInterval = defaultFederationHealthInterval
+	if fc.HealthInterval != "" {
+		if fc.healthInterval, err = time.ParseDuration(fc.HealthInterval); err != nil {
+			return fmt.Errorf("federation health interval: %s", err)
+		}
+		if fc.healthInterval <= 0 {
+			return fmt.Errorf("federation health interval must be positive")
+		}
+	}
+
+	return nil
+}
+
+// PeerConfig peer ydls instance, empty Formats handles all formats
+type PeerConfig struct {
+	URL     string
+	Formats []string
+	Proxy   bool
+}
+
+func (pc *PeerConfig) UnmarshalJSON(b []byte) (err error) {
+	type PeerConfigRaw PeerConfig
+	var pcr PeerConfigRaw
+	if err := json.Unmarshal(b, &pcr); err != nil {
+		return err
+	}
+	*pc = PeerConfig(pcr)
+
+	u, err := url.Parse(pc.URL)
+	if err != nil {
+		return fmt.Errorf("peer url: %s", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("peer url must be http or https: %s", pc.URL)
+	}
+
+	return nil
+}
+
+// PrepareConfig prepare media in background for clients to poll and fetch later
+type PrepareConfig struct {
+	Dir     string
+	TTL     string
+	MaxWait string
+	Timeout string
+	MaxJobs int
+	MaxSize int64
+
+	ttl     time.Duration
+	maxWait time.Duration
+	timeout time.Duration
+}
+
+const defaultPrepareMaxWait = 60 * time.Second
+const defaultPrepareTimeout = time.Hour
+const defaultPrepareMaxJobs = 10
+
+func (pc *PrepareConfig) UnmarshalJSON(b []byte) (err error) {
+	type PrepareConfigRaw PrepareConfig
+	var pcr PrepareConfigRaw
+	if err := json.Unmarshal(b, &pcr); err != nil {
+		return err
+	}
+	*pc = PrepareConfig(pcr)
+
+	if pc.TTL != "" {
+		if pc.ttl, err = time.ParseDuration(pc.TTL); err != nil {
+			return fmt.Errorf("prepare ttl: %s", err)
+		}
+	}
+	pc.maxWait = defaultPrepareMaxWait
+	if pc.MaxWait != "" {
+		if pc.maxWait, err = time.ParseDuration(pc.MaxWait); err != nil {
+			return fmt.Errorf("prepare max wait: %s", err)
+		}
+	}
+	pc.timeout = defaultPrepareTimeout
+	if pc.Timeout != "" {
+		if pc.timeout, err = time.ParseDuration(pc.Timeout); err != nil {
+			return fmt.Errorf("prepare timeout: %s", err)
+		}
+	}
+	if pc.MaxJobs == 0 {
+		pc.MaxJobs = defaultPrepareMaxJobs
+	}
+
+	return nil
+}
+
+// SpoolConfig adaptive spooling of output to disk for slow clients on long media
+type SpoolConfig struct {
+	Dir               string
+	ProbeBytes        int64
+	MinDuration       string
+	MinBytesPerSecond float64
+	MaxSize           int64
+	MaxSpools         int
+
+	minDuration time.Duration
+}
+
+// probe has to be a lot larger than socket buffers to measure client throughput
+const minSpoolProbeBytes = 4 * 1024 * 1024
+
+func (sc *SpoolConfig) UnmarshalJSON(b []byte) (err error) {
+	type SpoolConfigRaw SpoolConfig
+	var scr SpoolConfigRaw
+	if err := json.Unmarshal(b, &scr); err != nil {
+		return err
+	}
+	*sc = SpoolConfig(scr)
+
+	if sc.ProbeBytes != 0 && sc.ProbeBytes < minSpoolProbeBytes {
+		return fmt.Errorf("spool probe bytes must be at least %d", minSpoolProbeBytes)
+	}
+	if sc.MinDuration != "" {
+		if sc.minDuration, err = time.ParseDuration(sc.MinDuration); err != nil {
+			return fmt.Errorf("spool min duration: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// ComplianceConfig regional compliance denylist file path or URL and refresh interval
+type ComplianceConfig struct {
+	Country         string
+	Denylist        string
+	RefreshInterval string
+
+	refreshInterval time.Duration
+}
+
+func (cc *ComplianceConfig) UnmarshalJSON(b []byte) (err error) {
+	type ComplianceConfigRaw ComplianceConfig
+	var ccr ComplianceConfigRaw
+	if err := json.Unmarshal(b, &ccr); err != nil {
+		return err
+	}
+	*cc = ComplianceConfig(ccr)
+
+	if cc.RefreshInterval != "" {
+		if cc.refreshInterval, err = time.ParseDuration(cc.RefreshInterval); err != nil {
+			return fmt.Errorf("compliance refresh interval: %s", err)
+		}
+	}
+
+	return nil
 }
 
 // Format media container format, possible codecs, extension and mime
@@ -117,15 +299,90 @@ func (f Format) String() string {
 // Formats ordered list of Formats
 type Formats map[string]Format
 
-// FindByName find format by name
+// FindName find configured format name, exact match first then case-insensitive
+func (fs Formats) FindName(name string) (string, bool) {
+	if _, ok := fs[name]; ok {
+		return name, true
+	}
+
+	// sort to be deterministic if names only differ by case
+	var names []string
+	for formatName := range fs {
+		if strings.EqualFold(formatName, name) {
+			names = append(names, formatName)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	sort.Strings(names)
+
+	return names[0], true
+}
+
+// FindByName find format by name, case-insensitive
 func (fs Formats) FindByName(name string) (Format, bool) {
-	for formatName, format := range fs {
-		if formatName == name {
-			return format, true
+	formatName, ok := fs.FindName(name)
+	if !ok {
+		return Format{}, false
+	}
+
+	return fs[formatName], true
+}
+
+// maxFormatSuggestions max number of suggestions for unknown format name
+const maxFormatSuggestions = 3
+
+// Suggest format names close to name, closest first
+func (fs Formats) Suggest(name string) []string {
+	type suggestion struct {
+		name     string
+		distance int
+	}
+
+	lowerName := strings.ToLower(name)
+	// allow about one edit per three characters
+	maxDistance := len([]rune(lowerName))/3 + 1
+
+	var suggestions []suggestion
+	for formatName := range fs {
+		d := levenshtein.Distance(lowerName, strings.ToLower(formatName))
+		if d > maxDistance {
+			continue
 		}
+		suggestions = append(suggestions, suggestion{name: formatName, distance: d})
+	}
+
+	sort.Slice(suggestions, func(i int, j int) bool {
+		if suggestions[i].distance != suggestions[j].distance {
+			return suggestions[i].distance < suggestions[j].distance
+		}
+		return suggestions[i].name < suggestions[j].name
+	})
+
+	var names []string
+	for i, s := range suggestions {
+		if i == maxFormatSuggestions {
+			break
+		}
+		names = append(names, s.name)
+	}
+
+	return names
+}
+
+// UnknownFormatError format name not found, with close format names
+type UnknownFormatError struct {
+	Name        string
+	Suggestions []string
+}
+
+func (e UnknownFormatError) Error() string {
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("unknown format %s", e.Name)
 	}
 
-	return Format{}, false
+	return fmt.Sprintf("unknown format %s, did you mean %s?", e.Name, strings.Join(e.Suggestions, ", "))
 }
 
 // FindByFormatCodecs find format by format and codecs
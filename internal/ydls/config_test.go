@@ -6,6 +6,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -240,3 +241,63 @@ func TestFindByFormatCodecs(t *testing.T) {
 	}
 
 }
+
+func TestFindName(t *testing.T) {
+	fs := Formats{"mp3": Format{}, "MKV": Format{}, "mkv": Format{}, "WebM": Format{}}
+
+	for _, c := range []struct {
+		name     string
+		expected string
+		found    bool
+	}{
+		{"mp3", "mp3", true},
+		{"MP3", "mp3", true},
+		{"mkv", "mkv", true},
+		{"MKV", "MKV", true},
+		{"Mkv", "MKV", true},
+		{"webm", "WebM", true},
+		{"mp4", "", false},
+	} {
+		actual, found := fs.FindName(c.name)
+		if actual != c.expected || found != c.found {
+			t.Errorf("%s, got %s %v expected %s %v", c.name, actual, found, c.expected, c.found)
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	fs := Formats{"mp3": Format{}, "mp4": Format{}, "m4a": Format{}, "mkv": Format{}, "webm": Format{}, "flac": Format{}}
+
+	for _, c := range []struct {
+		name     string
+		expected []string
+	}{
+		{"mp5", []string{"mp3", "mp4", "m4a"}},
+		{"WEBN", []string{"webm"}},
+		{"falc", []string{"flac"}},
+		{"something", nil},
+	} {
+		actual := fs.Suggest(c.name)
+		if !reflect.DeepEqual(actual, c.expected) {
+			t.Errorf("%s, got %v expected %v", c.name, actual, c.expected)
+		}
+	}
+}
+
+func TestSpoolConfig(t *testing.T) {
+	c, err := parseConfig(strings.NewReader(`{"Spool": {"ProbeBytes": 8388608, "MinDuration": "10m"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Spool.ProbeBytes != 8388608 || c.Spool.minDuration != time.Minute*10 {
+		t.Errorf("got %+v", c.Spool)
+	}
+
+	if _, err := parseConfig(strings.NewReader(`{"Spool": {"ProbeBytes": 1000}}`)); err == nil {
+		t.Error("expected error for too small probe bytes")
+	}
+
+	if _, err := parseConfig(strings.NewReader(`{"Spool": {"MinDuration": "nope"}}`)); err == nil {
+		t.Error("expected error for invalid duration")
+	}
+}
@@ -0,0 +1,324 @@
+package ydls
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wader/ydls/internal/ffmpeg"
+)
+
+// how long a peer signed URL is valid, only needs to cover redirect roundtrip
+const peerSignatureTTL = 5 * time.Minute
+
+const peerHealthTimeout = 5 * time.Second
+
+const encodersProbeTimeout = 10 * time.Second
+
+type peer struct {
+	config  PeerConfig
+	baseURL *url.URL
+	client  *http.Client
+
+	mutex   sync.Mutex
+	healthy bool
+}
+
+func (p *peer) supportsFormat(format string) bool {
+	if len(p.config.Formats) == 0 {
+		return true
+	}
+	for _, f := range p.config.Formats {
+		if strings.EqualFold(f, format) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *peer) setHealthy(healthy bool) {
+	p.mutex.Lock()
+	p.healthy = healthy
+	p.mutex.Unlock()
+}
+
+// isHealthy result of last health check
+func (p *peer) isHealthy() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.healthy
+}
+
+func (p *peer) checkHealth() {
+	resp, err := p.client.Get(p.baseURL.String() + "/health")
+	if err == nil {
+		resp.Body.Close()
+	}
+	p.setHealthy(err == nil && resp.StatusCode == http.StatusOK)
+}
+
+// RoundTrip marks peer as unhealthy on proxy transport errors, but not if
+// client gave up on the request
+func (p *peer) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err != nil && r.Context().Err() == nil {
+		p.setHealthy(false)
+	}
+	return resp, err
+}
+
+type federation struct {
+	secret []byte
+	peers  []*peer
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	mutex sync.Mutex
+	// encoders available to local ffmpeg, nil if not probed yet
+	encoders map[string]bool
+}
+
+func (yh *Handler) federation() *federation {
+	yh.federationOnce.Do(func() {
+		fc := yh.YDLS.Config.Federation
+		f := &federation{
+			secret: []byte(fc.Secret),
+			stopCh: make(chan struct{}),
+			doneCh: make(chan struct{}),
+		}
+		for _, pc := range fc.Peers {
+			// validated when config was parsed
+			baseURL, _ := url.Parse(strings.TrimSuffix(pc.URL, "/"))
+			f.peers = append(f.peers, &peer{
+				config:  pc,
+				baseURL: baseURL,
+				client:  &http.Client{Timeout: peerHealthTimeout},
+			})
+		}
+
+		if len(f.peers) > 0 {
+			go f.healthLoop(fc.healthInterval)
+		} else {
+			close(f.doneCh)
+		}
+
+		yh.fed = f
+	})
+
+	return yh.fed
+}
+
+// check health of all peers now and then every interval until closed,
+// local encoders are probed the same way until it succeeds
+func (f *federation) healthLoop(interval time.Duration) {
+	defer close(f.doneCh)
+
+	f.checkPeers()
+	f.probeEncoders()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-f.stopCh:
+			return
+		case <-t.C:
+			f.checkPeers()
+			f.probeEncoders()
+		}
+	}
+}
+
+func (f *federation) probeEncoders() {
+	f.mutex.Lock()
+	probed := f.encoders != nil
+	f.mutex.Unlock()
+	if probed {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), encodersProbeTimeout)
+	encoders, err := ffmpeg.Encoders(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	f.setEncoders(encoders)
+}
+
+func (f *federation) setEncoders(encoders map[string]bool) {
+	f.mutex.Lock()
+	f.encoders = encoders
+	f.mutex.Unlock()
+}
+
+func (f *federation) checkPeers() {
+	var wg sync.WaitGroup
+	for _, p := range f.peers {
+		wg.Add(1)
+		go func(p *peer) {
+			p.checkHealth()
+			wg.Done()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// close stops health checks
+func (f *federation) close() {
+	close(f.stopCh)
+	<-f.doneCh
+}
+
+// canEncode false if local ffmpeg has no encoder for a codec the format
+// would be transcoded to, true if encoders are not known yet
+func (f *federation) canEncode(config Config, options DownloadOptions) bool {
+	f.mutex.Lock()
+	encoders := f.encoders
+	f.mutex.Unlock()
+	if encoders == nil || options.Format == "" {
+		return true
+	}
+	format, ok := config.Formats.FindByName(options.Format)
+	if !ok {
+		return true
+	}
+
+	for _, s := range format.Streams {
+		if len(s.Codecs) == 0 {
+			continue
+		}
+		c := chooseCodec(s.Codecs, options.Codecs, nil)
+		if !encoders[firstNonEmpty(config.CodecMap[c.Name], c.Name)] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *federation) signature(expires int64, requestURI string) string {
+	mac := hmac.New(sha256.New, f.secret)
+	fmt.Fprintf(mac, "%d\n%s", expires, requestURI)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign request URI, returns /peer/expires/signature/requestURI
+func (f *federation) sign(requestURI string, now time.Time) string {
+	expires := now.Add(peerSignatureTTL).Unix()
+	return fmt.Sprintf("/peer/%d/%s%s", expires, f.signature(expires, requestURI), requestURI)
+}
+
+// verify signed peer URL and return original request URL
+func (f *federation) verify(signedURL *url.URL, now time.Time) (*url.URL, error) {
+	// "", "peer", expires, signature, rest...
+	parts := strings.SplitN(signedURL.RequestURI(), "/", 5)
+	if len(parts) != 5 || parts[1] != "peer" {
+		return nil, fmt.Errorf("invalid peer URL")
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer URL expires")
+	}
+	requestURI := "/" + parts[4]
+
+	expectedSignature := f.signature(expires, requestURI)
+	if !hmac.Equal([]byte(parts[3]), []byte(expectedSignature)) {
+		return nil, fmt.Errorf("invalid peer signature")
+	}
+	if now.Unix() > expires {
+		return nil, fmt.Errorf("expired peer signature")
+	}
+
+	return url.ParseRequestURI(requestURI)
+}
+
+// find healthy peer that supports format
+func (f *federation) findPeer(format string) *peer {
+	for _, p := range f.peers {
+		if p.supportsFormat(format) && p.isHealthy() {
+			return p
+		}
+	}
+	return nil
+}
+
+func (yh *Handler) overCapacity() bool {
+	maxDownloads := yh.YDLS.Config.Federation.MaxDownloads
+	return maxDownloads > 0 && int(atomic.LoadInt32(&yh.activeDownloads)) >= maxDownloads
+}
+
+// serveHealth used by peers to check health and capacity
+func (yh *Handler) serveHealth(w http.ResponseWriter) {
+	if yh.overCapacity() {
+		http.Error(w, "Over capacity", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Write([]byte("ok\n"))
+}
+
+// forwardToPeer redirect or proxy request to a peer if format is not known or
+// can't be encoded locally or if over capacity. Returns false if request should
+// be handled locally.
+func (yh *Handler) forwardToPeer(w http.ResponseWriter, r *http.Request, infoLog *log.Logger) bool {
+	f := yh.federation()
+
+	var format string
+	var downloadURL string
+	downloadOptions, err := yh.parseFormatDownloadURL(r.URL)
+	if ufErr, ok := err.(UnknownFormatError); ok {
+		format = ufErr.Name
+		downloadURL = requestDownloadURL(r.URL)
+	} else if err == nil && (yh.overCapacity() || !f.canEncode(yh.YDLS.Config, downloadOptions)) {
+		format = downloadOptions.Format
+		downloadURL = downloadOptions.URL
+	} else {
+		return false
+	}
+
+	p := f.findPeer(format)
+	if p == nil {
+		return false
+	}
+
+	// blocked media should not reach the client through a peer either
+	if err := yh.YDLS.checkURL(downloadURL); err != nil {
+		infoLog.Printf("%s Download failed %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
+		http.Error(w, err.Error(), downloadErrorStatus(err))
+		return true
+	}
+
+	signedURL, err := url.Parse(p.baseURL.String() + f.sign(r.URL.RequestURI(), time.Now()))
+	if err != nil {
+		return false
+	}
+
+	if !p.config.Proxy {
+		infoLog.Printf("%s Redirecting (%s) to peer %s", r.RemoteAddr, firstNonEmpty(format, "best"), p.baseURL)
+		http.Redirect(w, r, signedURL.String(), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	infoLog.Printf("%s Proxying (%s) to peer %s", r.RemoteAddr, firstNonEmpty(format, "best"), p.baseURL)
+	rp := &httputil.ReverseProxy{
+		Director: func(pr *http.Request) {
+			pr.URL = signedURL
+			pr.Host = signedURL.Host
+		},
+		Transport: p,
+	}
+	rp.ServeHTTP(w, r)
+
+	return true
+}
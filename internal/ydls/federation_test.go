@@ -0,0 +1,252 @@
+package ydls
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wader/ydls/internal/leaktest"
+)
+
+func TestPeerSignVerify(t *testing.T) {
+	f := &federation{secret: []byte("secret")}
+	now := time.Now()
+	requestURI := "/mp3/https://domain.com/path?a=1&b=2"
+
+	signedURL, err := url.Parse("http://peer" + f.sign(requestURI, now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := f.verify(signedURL, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.RequestURI() != requestURI {
+		t.Errorf("expected %s, got %s", requestURI, u.RequestURI())
+	}
+
+	if _, err := f.verify(signedURL, now.Add(peerSignatureTTL+time.Second)); err == nil {
+		t.Error("expected expired signature error")
+	}
+
+	otherF := &federation{secret: []byte("other")}
+	if _, err := otherF.verify(signedURL, now); err == nil {
+		t.Error("expected invalid signature error for other secret")
+	}
+
+	tamperedURL, _ := url.Parse(strings.Replace(signedURL.String(), "mp3", "ogg", 1))
+	if _, err := f.verify(tamperedURL, now); err == nil {
+		t.Error("expected invalid signature error for tampered URL")
+	}
+}
+
+func federationTestHandler(t *testing.T, fc FederationConfig) *Handler {
+	h := ydlsHandlerFromEnv(t)
+	fc.Secret = "secret"
+	fc.healthInterval = time.Hour
+	h.YDLS.Config.Federation = fc
+	return h
+}
+
+func TestFederationForward(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	peerH := federationTestHandler(t, FederationConfig{PeerOnly: true})
+	peerS := httptest.NewServer(peerH)
+	defer peerS.Close()
+
+	for _, proxy := range []bool{false, true} {
+		h := federationTestHandler(t, FederationConfig{
+			Peers: []PeerConfig{{URL: peerS.URL, Formats: []string{"nvenc"}, Proxy: proxy}},
+		})
+		f := h.federation()
+		defer f.close()
+		f.checkPeers()
+
+		// known format is handled locally
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "http://hostname/mp3/badurl", nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("proxy=%v, expected bad request, got %d", proxy, rr.Code)
+		}
+
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "http://hostname/NVENC/badurl", nil))
+		resp := rr.Result()
+		body, _ := ioutil.ReadAll(resp.Body)
+
+		if !proxy {
+			location := resp.Header.Get("Location")
+			if resp.StatusCode != http.StatusTemporaryRedirect || !strings.HasPrefix(location, peerS.URL+"/peer/") {
+				t.Fatalf("expected redirect to peer, got %d %s", resp.StatusCode, location)
+			}
+			peerResp, err := http.Get(location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ = ioutil.ReadAll(peerResp.Body)
+			peerResp.Body.Close()
+			resp = peerResp
+		}
+
+		// peer accepted signature and did not forward again, it does not know the format either
+		if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "unknown format NVENC") {
+			t.Errorf("proxy=%v, expected peer unknown format, got %d %s", proxy, resp.StatusCode, body)
+		}
+	}
+
+	// unsigned requests to peer only instance are forbidden
+	resp, err := http.Get(peerS.URL + "/mp3/badurl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected forbidden, got %d", resp.StatusCode)
+	}
+}
+
+func TestFederationDenylist(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	peerH := federationTestHandler(t, FederationConfig{})
+	peerS := httptest.NewServer(peerH)
+	defer peerS.Close()
+
+	for _, proxy := range []bool{false, true} {
+		h := federationTestHandler(t, FederationConfig{
+			Peers: []PeerConfig{{URL: peerS.URL, Proxy: proxy}},
+		})
+		h.YDLS.denylist = testDenylist(t, 0, "domain blocked.com\n")
+		f := h.federation()
+		defer f.close()
+		f.checkPeers()
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest("GET", "http://hostname/NVENC/https://blocked.com/a", nil))
+		if rr.Code != http.StatusUnavailableForLegalReasons {
+			t.Errorf("proxy=%v, expected unavailable for legal reasons, got %d", proxy, rr.Code)
+		}
+	}
+}
+
+func TestPeerRoundTripCanceled(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// nothing listens on a closed server
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	p := &peer{healthy: true}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := http.NewRequest("GET", s.URL, nil)
+	if _, err := p.RoundTrip(r.WithContext(ctx)); err == nil {
+		t.Fatal("expected canceled request error")
+	}
+	if !p.isHealthy() {
+		t.Error("expected peer to stay healthy when client canceled")
+	}
+
+	if _, err := p.RoundTrip(r); err == nil {
+		t.Fatal("expected connection error")
+	}
+	if p.isHealthy() {
+		t.Error("expected peer to be unhealthy after connection error")
+	}
+}
+
+func TestFederationUnhealthyPeer(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	peerH := federationTestHandler(t, FederationConfig{MaxDownloads: 1})
+	peerH.activeDownloads = 1
+	peerS := httptest.NewServer(peerH)
+	defer peerS.Close()
+
+	h := federationTestHandler(t, FederationConfig{
+		MaxDownloads: 1,
+		Peers:        []PeerConfig{{URL: peerS.URL}},
+	})
+	h.activeDownloads = 1
+	f := h.federation()
+	defer f.close()
+	f.checkPeers()
+	if f.peers[0].isHealthy() {
+		t.Error("expected peer over capacity to be unhealthy")
+	}
+
+	// over capacity but peer is also over capacity, handle locally
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "http://hostname/mp3/badurl", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %d", rr.Code)
+	}
+}
+
+func TestFederationCanEncode(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	peerH := federationTestHandler(t, FederationConfig{})
+	peerS := httptest.NewServer(peerH)
+	defer peerS.Close()
+
+	h := federationTestHandler(t, FederationConfig{
+		Peers: []PeerConfig{{URL: peerS.URL}},
+	})
+	f := h.federation()
+	defer f.close()
+	f.checkPeers()
+	// as if local ffmpeg had no mp3 encoder
+	f.setEncoders(map[string]bool{"libfdk_aac": true})
+
+	config := h.YDLS.Config
+	for _, c := range []struct {
+		options  DownloadOptions
+		expected bool
+	}{
+		{DownloadOptions{}, true},
+		{DownloadOptions{Format: "mp3"}, false},
+		{DownloadOptions{Format: "m4a"}, true},
+	} {
+		if actual := f.canEncode(config, c.options); actual != c.expected {
+			t.Errorf("%+v, expected %v, got %v", c.options, c.expected, actual)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "http://hostname/mp3/badurl", nil))
+	if rr.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected redirect to peer, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", "http://hostname/m4a/badurl", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected bad request, got %d", rr.Code)
+	}
+}
+
+func TestFederationConfig(t *testing.T) {
+	for _, c := range []struct {
+		json        string
+		expectedErr bool
+	}{
+		{`{"Federation": {"Secret": "s", "Peers": [{"URL": "https://peer"}]}}`, false},
+		{`{"Federation": {"Peers": [{"URL": "https://peer"}]}}`, true},
+		{`{"Federation": {"Secret": "s", "Peers": [{"URL": "peer"}]}}`, true},
+		{`{"Federation": {"Secret": "s", "HealthInterval": "nope"}}`, true},
+		{`{"Federation": {"Secret": "s", "HealthInterval": "0s"}}`, true},
+	} {
+		_, err := parseConfig(strings.NewReader(c.json))
+		if (err != nil) != c.expectedErr {
+			t.Errorf("%s, got error %v expected error %v", c.json, err, c.expectedErr)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package ydls
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wader/ydls/internal/timerange"
+	"github.com/wader/ydls/internal/youtubedl"
+)
+
+// FilterOptNames option names that can be used as filters
+var FilterOptNames = []string{"after", "before", "min_duration", "max_duration"}
+
+// Filter constraints on upload date and duration, zero values are ignored
+type Filter struct {
+	After       time.Time // uploaded on or after date
+	Before      time.Time // uploaded before date
+	MinDuration time.Duration
+	MaxDuration time.Duration
+}
+
+// FilterError media did not match filter
+type FilterError string
+
+func (e FilterError) Error() string {
+	return string(e)
+}
+
+// YYYY-MM-DD or youtube-dl style YYYYMMDD
+func parseDate(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "20060102"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("could not parse date %s", s)
+}
+
+// IsZero is filter empty
+func (f Filter) IsZero() bool {
+	return f == Filter{}
+}
+
+// parseOpt parse "name=value" filter option, returns false if not a filter option
+func (f *Filter) parseOpt(opt string) (bool, error) {
+	parts := strings.SplitN(opt, "=", 2)
+	if len(parts) != 2 {
+		return false, nil
+	}
+	name, value := parts[0], parts[1]
+
+	var err error
+	switch name {
+	case "after":
+		f.After, err = parseDate(value)
+	case "before":
+		f.Before, err = parseDate(value)
+	case "min_duration":
+		f.MinDuration, err = timerange.ParseDuration(value)
+	case "max_duration":
+		f.MaxDuration, err = timerange.ParseDuration(value)
+	default:
+		return false, nil
+	}
+	if err != nil {
+		return true, fmt.Errorf("%s: %s", name, err)
+	}
+
+	return true, nil
+}
+
+// Match returns FilterError if info does not match filter
+// unknown upload date or duration does not match if constrained
+func (f Filter) Match(yi youtubedl.Info) error {
+	if !f.After.IsZero() || !f.Before.IsZero() {
+		uploadDate, err := parseDate(yi.UploadDate)
+		if err != nil {
+			return FilterError("unknown upload date")
+		}
+		if !f.After.IsZero() && uploadDate.Before(f.After) {
+			return FilterError(fmt.Sprintf("uploaded %s before %s",
+				uploadDate.Format("2006-01-02"), f.After.Format("2006-01-02")))
+		}
+		if !f.Before.IsZero() && !uploadDate.Before(f.Before) {
+			return FilterError(fmt.Sprintf("uploaded %s not before %s",
+				uploadDate.Format("2006-01-02"), f.Before.Format("2006-01-02")))
+		}
+	}
+
+	if f.MinDuration != 0 || f.MaxDuration != 0 {
+		if yi.Duration <= 0 {
+			return FilterError("unknown duration")
+		}
+		duration := time.Duration(yi.Duration * float64(time.Second))
+		if f.MinDuration != 0 && duration < f.MinDuration {
+			return FilterError(fmt.Sprintf("duration %s shorter than %s", duration, f.MinDuration))
+		}
+		if f.MaxDuration != 0 && duration > f.MaxDuration {
+			return FilterError(fmt.Sprintf("duration %s longer than %s", duration, f.MaxDuration))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package ydls
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wader/ydls/internal/youtubedl"
+)
+
+func TestFilterParseOpt(t *testing.T) {
+	for _, c := range []struct {
+		opt         string
+		expected    Filter
+		expectedOk  bool
+		expectedErr bool
+	}{
+		{"mp3", Filter{}, false, false},
+		{"other=1", Filter{}, false, false},
+		{"after=2018-01-02", Filter{After: time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)}, true, false},
+		{"before=20180102", Filter{Before: time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)}, true, false},
+		{"min_duration=10m", Filter{MinDuration: time.Minute * 10}, true, false},
+		{"max_duration=2h", Filter{MaxDuration: time.Hour * 2}, true, false},
+		{"after=2018", Filter{}, true, true},
+		{"max_duration=a", Filter{}, true, true},
+	} {
+		var f Filter
+		ok, err := f.parseOpt(c.opt)
+		if ok != c.expectedOk || (err != nil) != c.expectedErr {
+			t.Errorf("%s, got ok=%v err=%v expected ok=%v err=%v", c.opt, ok, err, c.expectedOk, c.expectedErr)
+		} else if err == nil && f != c.expected {
+			t.Errorf("%s, got %+v expected %+v", c.opt, f, c.expected)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	date := func(s string) time.Time {
+		d, _ := parseDate(s)
+		return d
+	}
+
+	for _, c := range []struct {
+		filter   Filter
+		info     youtubedl.Info
+		expected bool
+	}{
+		{Filter{}, youtubedl.Info{}, true},
+		{Filter{After: date("20180102")}, youtubedl.Info{UploadDate: "20180102"}, true},
+		{Filter{After: date("20180102")}, youtubedl.Info{UploadDate: "20180101"}, false},
+		{Filter{Before: date("20180102")}, youtubedl.Info{UploadDate: "20180101"}, true},
+		{Filter{Before: date("20180102")}, youtubedl.Info{UploadDate: "20180102"}, false},
+		{Filter{After: date("20180102")}, youtubedl.Info{}, false},
+		{Filter{MinDuration: time.Minute}, youtubedl.Info{Duration: 60}, true},
+		{Filter{MinDuration: time.Minute}, youtubedl.Info{Duration: 59.5}, false},
+		{Filter{MaxDuration: time.Minute}, youtubedl.Info{Duration: 60}, true},
+		{Filter{MaxDuration: time.Minute}, youtubedl.Info{Duration: 60.5}, false},
+		{Filter{MaxDuration: time.Minute}, youtubedl.Info{}, false},
+	} {
+		err := c.filter.Match(c.info)
+		if _, isFilterErr := err.(FilterError); (err == nil) != c.expected || (err != nil && !isFilterErr) {
+			t.Errorf("%+v %+v, got %v expected match %v", c.filter, c.info, err, c.expected)
+		}
+	}
+}
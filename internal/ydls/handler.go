@@ -8,6 +8,12 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wader/ydls/internal/denylist"
+	"github.com/wader/ydls/internal/spool"
 )
 
 // URL encode with space encoded as "%20"
@@ -71,6 +77,23 @@ type Handler struct {
 	IndexTmpl *template.Template
 	InfoLog   *log.Logger
 	DebugLog  *log.Logger
+
+	prepareOnce sync.Once
+	prepare     *prepareCache
+
+	federationOnce  sync.Once
+	fed             *federation
+	activeDownloads int32
+	activeSpools    int32
+}
+
+// download URL from ?url=url or /format+opts.../url request URL
+func requestDownloadURL(URL *url.URL) string {
+	if urlStr := URL.Query().Get("url"); urlStr != "" {
+		return urlStr
+	}
+	_, urlStr := splitRequestURL(URL)
+	return urlStr
 }
 
 func (yh *Handler) parseFormatDownloadURL(URL *url.URL) (DownloadOptions, error) {
@@ -78,7 +101,7 @@ func (yh *Handler) parseFormatDownloadURL(URL *url.URL) (DownloadOptions, error)
 	var optStrings []string
 
 	if URL.Query().Get("url") != "" {
-		// ?url=url&format=format&codec=&codec=...
+		// ?url=url&format=format&codec=&codec=...&after=...
 
 		urlStr = URL.Query().Get("url")
 
@@ -93,12 +116,21 @@ func (yh *Handler) parseFormatDownloadURL(URL *url.URL) (DownloadOptions, error)
 		if v := URL.Query().Get("time"); v != "" {
 			optStrings = append(optStrings, v)
 		}
+		for _, n := range FilterOptNames {
+			if v := URL.Query().Get(n); v != "" {
+				optStrings = append(optStrings, n+"="+v)
+			}
+		}
 	} else {
 		// /format+opts.../url
 
 		var formatAndOpts string
 		formatAndOpts, urlStr = splitRequestURL(URL)
 		optStrings = strings.Split(formatAndOpts, "+")
+		// filter options without format, /max_duration=10m/url
+		if strings.Contains(optStrings[0], "=") {
+			optStrings = append([]string{""}, optStrings...)
+		}
 	}
 
 	if len(optStrings) == 0 {
@@ -108,6 +140,54 @@ func (yh *Handler) parseFormatDownloadURL(URL *url.URL) (DownloadOptions, error)
 	return yh.YDLS.ParseDownloadOptions(urlStr, optStrings[0], optStrings[1:])
 }
 
+// parse and validate download options from request URL, responds with
+// error and returns false if invalid
+func (yh *Handler) requestDownloadOptions(w http.ResponseWriter, r *http.Request, URL *url.URL, infoLog *log.Logger) (DownloadOptions, bool) {
+	downloadOptions, err := yh.parseFormatDownloadURL(URL)
+	if err != nil {
+		infoLog.Printf("%s Invalid request %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
+		if _, ok := err.(UnknownFormatError); ok {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return DownloadOptions{}, false
+	}
+
+	if url, urlErr := url.Parse(downloadOptions.URL); urlErr != nil {
+		infoLog.Printf("%s Invalid download URL %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, urlErr.Error())
+		http.Error(w, urlErr.Error(), http.StatusBadRequest)
+		return DownloadOptions{}, false
+	} else if url.Scheme != "http" && url.Scheme != "https" {
+		infoLog.Printf("%s Invalid URL scheme %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, url.Scheme)
+		http.Error(w, "Invalid download URL scheme", http.StatusBadRequest)
+		return DownloadOptions{}, false
+	}
+
+	return downloadOptions, true
+}
+
+// http status for download error
+func downloadErrorStatus(err error) int {
+	if _, ok := err.(denylist.Error); ok {
+		return http.StatusUnavailableForLegalReasons
+	}
+	if _, ok := err.(FilterError); ok {
+		return http.StatusPreconditionFailed
+	}
+
+	return http.StatusBadRequest
+}
+
+func setMediaHeaders(w http.ResponseWriter, filename string, mimeType string) {
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; reflected-xss block")
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename*=UTF-8''%s; filename=\"%s\"",
+			urlEncode(filename), safeContentDispositionFilename(filename)),
+	)
+}
+
 func (yh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	infoLog := logOrDiscard(yh.InfoLog)
 	debugLog := logOrDiscard(yh.DebugLog)
@@ -122,6 +202,28 @@ func (yh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	fromPeer := false
+	if yh.YDLS.Config.Federation.Secret != "" {
+		if r.URL.Path == "/health" {
+			yh.serveHealth(w)
+			return
+		} else if _, ok := trimPathPrefix(r.URL.Path, "/peer"); ok {
+			peerURL, err := yh.federation().verify(r.URL, time.Now())
+			if err != nil {
+				infoLog.Printf("%s Invalid peer request %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			r2 := *r
+			r2.URL = peerURL
+			r = &r2
+			fromPeer = true
+		} else if yh.YDLS.Config.Federation.PeerOnly {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
 	if r.URL.Path == "/" && r.URL.RawQuery == "" {
 		if yh.IndexTmpl != nil {
 			w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'; form-action 'self'")
@@ -133,25 +235,29 @@ func (yh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	} else if r.URL.Path == "/favicon.ico" {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
+	} else if yh.YDLS.Config.Prepare.ttl != 0 {
+		if p, ok := trimPathPrefix(r.URL.Path, "/prepare"); ok {
+			yh.servePrepare(w, r, p, infoLog, debugLog)
+			return
+		} else if p, ok := trimPathPrefix(r.URL.Path, "/prepared"); ok {
+			yh.servePrepared(w, r, p, infoLog)
+			return
+		}
 	}
 
-	downloadOptions, err := yh.parseFormatDownloadURL(r.URL)
-	if err != nil {
-		infoLog.Printf("%s Invalid request %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// requests from peers are never forwarded again to prevent loops
+	if !fromPeer && yh.YDLS.Config.Federation.Secret != "" && yh.forwardToPeer(w, r, infoLog) {
 		return
 	}
 
-	if url, urlErr := url.Parse(downloadOptions.URL); err != nil {
-		infoLog.Printf("%s Invalid download URL %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, urlErr.Error())
-		http.Error(w, urlErr.Error(), http.StatusBadRequest)
-		return
-	} else if url.Scheme != "http" && url.Scheme != "https" {
-		infoLog.Printf("%s Invalid URL scheme %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, url.Scheme)
-		http.Error(w, "Invalid download URL scheme", http.StatusBadRequest)
+	downloadOptions, ok := yh.requestDownloadOptions(w, r, r.URL, infoLog)
+	if !ok {
 		return
 	}
 
+	atomic.AddInt32(&yh.activeDownloads, 1)
+	defer atomic.AddInt32(&yh.activeDownloads, -1)
+
 	infoLog.Printf("%s Downloading (%s) %s", r.RemoteAddr, firstNonEmpty(downloadOptions.Format, "best"), downloadOptions.URL)
 
 	dr, err := yh.YDLS.Download(
@@ -161,18 +267,68 @@ func (yh *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	)
 	if err != nil {
 		infoLog.Printf("%s Download failed %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), downloadErrorStatus(err))
 		return
 	}
 
-	w.Header().Set("Content-Security-Policy", "default-src 'none'; reflected-xss block")
-	w.Header().Set("Content-Type", dr.MIMEType)
-	w.Header().Set("Content-Disposition",
-		fmt.Sprintf("attachment; filename*=UTF-8''%s; filename=\"%s\"",
-			urlEncode(dr.Filename), safeContentDispositionFilename(dr.Filename)),
-	)
+	setMediaHeaders(w, dr.Filename, dr.MIMEType)
 
-	io.Copy(w, dr.Media)
+	yh.copyMedia(w, dr, r.RemoteAddr, debugLog)
 	dr.Media.Close()
 	dr.Wait()
 }
+
+// timedWriter measures time spent in writes
+type timedWriter struct {
+	w       io.Writer
+	elapsed time.Duration
+}
+
+func (tw *timedWriter) Write(p []byte) (n int, err error) {
+	start := time.Now()
+	n, err = tw.w.Write(p)
+	tw.elapsed += time.Since(start)
+	return n, err
+}
+
+// copyMedia streams media to client, switches to spooling if configured
+// and client is too slow for a long media
+func (yh *Handler) copyMedia(w io.Writer, dr DownloadResult, remoteAddr string, debugLog *log.Logger) {
+	sc := yh.YDLS.Config.Spool
+	if sc.ProbeBytes == 0 || dr.Duration < sc.minDuration {
+		io.Copy(w, dr.Media)
+		return
+	}
+
+	// only time writes so that waiting for transcoding output is not counted
+	tw := &timedWriter{w: w}
+	n, err := io.CopyN(tw, dr.Media, sc.ProbeBytes)
+	if err != nil {
+		return
+	}
+	bytesPerSecond := float64(n) / tw.elapsed.Seconds()
+	if bytesPerSecond >= sc.MinBytesPerSecond {
+		debugLog.Printf("%s Streaming (%.0f bytes/s)", remoteAddr, bytesPerSecond)
+		io.Copy(w, dr.Media)
+		return
+	}
+
+	if spools := atomic.AddInt32(&yh.activeSpools, 1); sc.MaxSpools > 0 && int(spools) > sc.MaxSpools {
+		atomic.AddInt32(&yh.activeSpools, -1)
+		debugLog.Printf("%s Too many spools, streaming instead (%.0f bytes/s)", remoteAddr, bytesPerSecond)
+		io.Copy(w, dr.Media)
+		return
+	}
+	defer atomic.AddInt32(&yh.activeSpools, -1)
+
+	s, err := spool.New(sc.Dir, dr.Media, sc.MaxSize)
+	if err != nil {
+		debugLog.Printf("%s Spool failed, streaming instead (%s)", remoteAddr, err)
+		io.Copy(w, dr.Media)
+		return
+	}
+	debugLog.Printf("%s Spooling (%.0f bytes/s)", remoteAddr, bytesPerSecond)
+	io.Copy(w, s)
+	debugLog.Printf("%s Spool done (spooled=%d)", remoteAddr, s.Written())
+	s.Close()
+}
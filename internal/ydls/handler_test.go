@@ -1,16 +1,21 @@
 package ydls
 
 import (
+	"bytes"
+	"errors"
 	"html/template"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/wader/ydls/internal/denylist"
 	"github.com/wader/ydls/internal/leaktest"
 	"github.com/wader/ydls/internal/timerange"
 )
@@ -31,6 +36,22 @@ func TestURLEncode(t *testing.T) {
 	}
 }
 
+func TestDownloadErrorStatus(t *testing.T) {
+	for _, c := range []struct {
+		err    error
+		expect int
+	}{
+		{FilterError("filtered"), http.StatusPreconditionFailed},
+		{denylist.Error{}, http.StatusUnavailableForLegalReasons},
+		{errors.New("other"), http.StatusBadRequest},
+	} {
+		actual := downloadErrorStatus(c.err)
+		if actual != c.expect {
+			t.Errorf("%v, got %v expected %v", c.err, actual, c.expect)
+		}
+	}
+}
+
 func TestSafeContentDispositionFilename(t *testing.T) {
 	for _, c := range []struct {
 		s      string
@@ -93,6 +114,23 @@ func TestParseFormatDownloadURL(t *testing.T) {
 			DownloadOptions{Format: "mkv", URL: "http://domain.com", TimeRange: timerange.TimeRange{Stop: time.Second * 123}}, false},
 		{&url.URL{Path: "/mkv+nope/http://domain.com", RawQuery: ""},
 			DownloadOptions{}, true},
+		{&url.URL{Path: "/MP3/http://domain.com", RawQuery: ""},
+			DownloadOptions{Format: "mp3", URL: "http://domain.com"}, false},
+		{&url.URL{Path: "/", RawQuery: "url=http://domain.com&format=Mkv&codec=flac"},
+			DownloadOptions{Format: "mkv", URL: "http://domain.com", Codecs: []string{"flac"}}, false},
+		{&url.URL{Path: "/", RawQuery: "url=http://domain.com&format=mp3&after=2018-01-02&max_duration=1h"},
+			DownloadOptions{Format: "mp3", URL: "http://domain.com", Filter: Filter{
+				After: time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC), MaxDuration: time.Hour}}, false},
+		{&url.URL{Path: "/", RawQuery: "url=http://domain.com&min_duration=10m"},
+			DownloadOptions{Format: "", URL: "http://domain.com", Filter: Filter{MinDuration: time.Minute * 10}}, false},
+		{&url.URL{Path: "/mp3+before=20180102/http://domain.com", RawQuery: ""},
+			DownloadOptions{Format: "mp3", URL: "http://domain.com", Filter: Filter{
+				Before: time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC)}}, false},
+		{&url.URL{Path: "/", RawQuery: "url=http://domain.com&format=mp3&after=nope"},
+			DownloadOptions{}, true},
+		{&url.URL{Path: "/max_duration=10m+after=2018-01-02/http://domain.com", RawQuery: ""},
+			DownloadOptions{Format: "", URL: "http://domain.com", Filter: Filter{
+				After: time.Date(2018, 1, 2, 0, 0, 0, 0, time.UTC), MaxDuration: time.Minute * 10}}, false},
 	} {
 		opts, err := h.parseFormatDownloadURL(c.url)
 		if err != nil {
@@ -104,7 +142,8 @@ func TestParseFormatDownloadURL(t *testing.T) {
 				t.Errorf("url=%+v, got %#v, expected error", c.url, opts)
 			} else if opts.Format != c.expectedOpts.Format || opts.URL != c.expectedOpts.URL ||
 				!reflect.DeepEqual(opts.Codecs, c.expectedOpts.Codecs) ||
-				opts.Retranscode != c.expectedOpts.Retranscode {
+				opts.Retranscode != c.expectedOpts.Retranscode ||
+				opts.Filter != c.expectedOpts.Filter {
 				t.Errorf("url=%+v, got %#v, expected %#v", c.url, opts, c.expectedOpts)
 			}
 		}
@@ -160,6 +199,30 @@ func TestYDLSHandlerBadURL(t *testing.T) {
 	}
 }
 
+func TestYDLSHandlerUnknownFormat(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	h := ydlsHandlerFromEnv(t)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://hostname/mp5/http://domain.com", nil)
+	h.ServeHTTP(rr, req)
+	resp := rr.Result()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(body), "did you mean mp3, mp4") {
+		t.Errorf("expected suggestions, got %s", string(body))
+	}
+}
+
 func TestYDLSHandlerIndexTemplate(t *testing.T) {
 	defer leaktest.Check(t)()
 
@@ -184,3 +247,56 @@ func TestYDLSHandlerIndexTemplate(t *testing.T) {
 		t.Errorf("expected hello, got %s", string(body))
 	}
 }
+
+type slowWriter struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (sw *slowWriter) Write(p []byte) (n int, err error) {
+	time.Sleep(sw.delay)
+	return sw.Buffer.Write(p)
+}
+
+func TestCopyMediaSpool(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	data := bytes.Repeat([]byte{0, 1, 2, 3}, 10000)
+
+	for _, c := range []struct {
+		config   SpoolConfig
+		duration time.Duration
+		delay    time.Duration
+		expected string
+	}{
+		{SpoolConfig{}, time.Hour, 0, ""},
+		{SpoolConfig{ProbeBytes: 1000, minDuration: time.Hour}, time.Minute, time.Millisecond, ""},
+		{SpoolConfig{ProbeBytes: 1000, MinBytesPerSecond: 1}, time.Hour, 0, "Streaming"},
+		{SpoolConfig{ProbeBytes: 1000, MinBytesPerSecond: 1e12}, time.Hour, time.Millisecond, "Spooling"},
+		{SpoolConfig{ProbeBytes: 1000, MinBytesPerSecond: 1e12, MaxSize: 1000}, time.Hour, time.Millisecond, "Spooling"},
+		{SpoolConfig{ProbeBytes: 1000, MinBytesPerSecond: 1e12, MaxSpools: 1}, time.Hour, time.Millisecond, "Too many spools"},
+	} {
+		h := &Handler{}
+		if c.config.MaxSpools > 0 {
+			// pretend another spool is active
+			h.activeSpools = 1
+		}
+		h.YDLS.Config.Spool = c.config
+		logBuf := &bytes.Buffer{}
+		sw := &slowWriter{delay: c.delay}
+
+		h.copyMedia(
+			sw,
+			DownloadResult{Media: ioutil.NopCloser(bytes.NewReader(data)), Duration: c.duration},
+			"remote",
+			log.New(logBuf, "", 0),
+		)
+
+		if !bytes.Equal(sw.Bytes(), data) {
+			t.Errorf("%+v, got %d bytes expected %d", c.config, sw.Len(), len(data))
+		}
+		if c.expected == "" && logBuf.Len() != 0 || !strings.Contains(logBuf.String(), c.expected) {
+			t.Errorf("%+v, expected log %q got %q", c.config, c.expected, logBuf.String())
+		}
+	}
+}
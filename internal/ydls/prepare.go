@@ -0,0 +1,363 @@
+package ydls
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wader/ydls/internal/timerange"
+)
+
+const (
+	prepareStatusPreparing = "preparing"
+	prepareStatusReady     = "ready"
+	prepareStatusFailed    = "failed"
+)
+
+// prepareStatus JSON response for prepare and prepared status endpoints
+type prepareStatus struct {
+	ID        string
+	Status    string
+	Error     string `json:",omitempty"`
+	StatusURL string
+	MediaURL  string `json:",omitempty"`
+	Filename  string `json:",omitempty"`
+}
+
+// failed jobs are kept shortly so that pollers can see the error
+const prepareFailedTTL = 30 * time.Second
+
+// errPrepareFull too many prepare jobs
+var errPrepareFull = fmt.Errorf("too many prepare jobs")
+
+// prepareJob media being downloaded into a file in background
+// fields except err, doneAt and accessedAt are only read after doneCh is closed
+type prepareJob struct {
+	id       string
+	path     string
+	filename string
+	mimeType string
+	cancel   context.CancelFunc
+	doneCh   chan struct{}
+
+	// protected by prepareCache mutex
+	err        error
+	doneAt     time.Time
+	accessedAt time.Time
+}
+
+func (j *prepareJob) isDone() bool {
+	select {
+	case <-j.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+type prepareCache struct {
+	dir      string
+	ttl      time.Duration
+	timeout  time.Duration
+	maxJobs  int
+	maxSize  int64
+	active   *int32 // running jobs are counted as active downloads
+	download func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error)
+
+	mutex sync.Mutex
+	jobs  map[string]*prepareJob
+}
+
+func (yh *Handler) prepareCache() *prepareCache {
+	yh.prepareOnce.Do(func() {
+		pc := yh.YDLS.Config.Prepare
+		yh.prepare = &prepareCache{
+			dir:      pc.Dir,
+			ttl:      pc.ttl,
+			timeout:  pc.timeout,
+			maxJobs:  pc.MaxJobs,
+			maxSize:  pc.MaxSize,
+			active:   &yh.activeDownloads,
+			download: yh.YDLS.Download,
+			jobs:     map[string]*prepareJob{},
+		}
+	})
+
+	return yh.prepare
+}
+
+// same options gives same id so that concurrent prepares share job
+func prepareID(options DownloadOptions) string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%#v", options)))
+	return hex.EncodeToString(h[:])
+}
+
+// remove expired jobs and cancel running jobs not polled within ttl,
+// caller must hold mutex
+func (pc *prepareCache) purge() {
+	for id, j := range pc.jobs {
+		switch {
+		case j.doneAt.IsZero():
+			if time.Since(j.accessedAt) > pc.ttl {
+				// job removes its own file when canceled
+				j.cancel()
+				delete(pc.jobs, id)
+			}
+		case j.err != nil:
+			if time.Since(j.doneAt) > prepareFailedTTL {
+				delete(pc.jobs, id)
+			}
+		default:
+			if time.Since(j.doneAt) > pc.ttl {
+				delete(pc.jobs, id)
+				os.Remove(j.path)
+			}
+		}
+	}
+}
+
+func (pc *prepareCache) get(id string) (*prepareJob, bool) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.purge()
+	j, ok := pc.jobs[id]
+	if ok {
+		j.accessedAt = time.Now()
+	}
+	return j, ok
+}
+
+// start job for options or return already existing job, a failed job is
+// restarted so clients can retry
+func (pc *prepareCache) start(options DownloadOptions, debugLog *log.Logger) (*prepareJob, error) {
+	id := prepareID(options)
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.purge()
+	if j, ok := pc.jobs[id]; ok && j.err == nil {
+		j.accessedAt = time.Now()
+		return j, nil
+	}
+	delete(pc.jobs, id)
+	if pc.maxJobs > 0 && len(pc.jobs) >= pc.maxJobs {
+		return nil, errPrepareFull
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pc.timeout)
+	j := &prepareJob{
+		id:         id,
+		cancel:     cancel,
+		doneCh:     make(chan struct{}),
+		accessedAt: time.Now(),
+	}
+	pc.jobs[id] = j
+
+	go func() {
+		atomic.AddInt32(pc.active, 1)
+		err := pc.run(ctx, j, options, debugLog)
+		atomic.AddInt32(pc.active, -1)
+
+		pc.mutex.Lock()
+		// purge might have canceled and removed the job after run checked
+		// context, nothing would remove the file then
+		if err == nil && (ctx.Err() != nil || pc.jobs[j.id] != j) {
+			os.Remove(j.path)
+			err = fmt.Errorf("prepare canceled")
+		}
+		j.err = err
+		j.doneAt = time.Now()
+		pc.mutex.Unlock()
+		cancel()
+		close(j.doneCh)
+
+		if err != nil {
+			debugLog.Printf("Prepare %s failed: %s", j.id, err)
+		} else {
+			debugLog.Printf("Prepare %s ready", j.id)
+		}
+	}()
+
+	return j, nil
+}
+
+func (pc *prepareCache) run(ctx context.Context, j *prepareJob, options DownloadOptions, debugLog *log.Logger) error {
+	f, err := ioutil.TempFile(pc.dir, "ydls-prepare")
+	if err != nil {
+		return err
+	}
+	j.path = f.Name()
+
+	dr, err := pc.download(ctx, options, debugLog)
+	if err != nil {
+		f.Close()
+		os.Remove(j.path)
+		return err
+	}
+
+	var r io.Reader = dr.Media
+	if pc.maxSize > 0 {
+		r = io.LimitReader(dr.Media, pc.maxSize+1)
+	}
+	n, copyErr := io.Copy(f, r)
+	if copyErr == nil && pc.maxSize > 0 && n > pc.maxSize {
+		copyErr = fmt.Errorf("prepared media larger than %d bytes", pc.maxSize)
+	}
+	// canceled or timed out download might look like a successful short copy
+	if copyErr == nil && ctx.Err() != nil {
+		copyErr = fmt.Errorf("prepare canceled: %s", ctx.Err())
+	}
+	dr.Media.Close()
+	dr.Wait()
+	closeErr := f.Close()
+	if copyErr != nil {
+		os.Remove(j.path)
+		return copyErr
+	}
+	if closeErr != nil {
+		os.Remove(j.path)
+		return closeErr
+	}
+
+	j.filename = dr.Filename
+	j.mimeType = dr.MIMEType
+
+	return nil
+}
+
+// "/prefix" or "/prefix/..." returns rest of path starting with "/"
+func trimPathPrefix(path string, prefix string) (string, bool) {
+	if path == prefix {
+		return "/", true
+	} else if strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix):], true
+	}
+
+	return "", false
+}
+
+// wait for job to be done, at most ?wait= duration limited by max wait
+func (yh *Handler) waitPrepareJob(r *http.Request, j *prepareJob) {
+	waitStr := r.URL.Query().Get("wait")
+	if waitStr == "" {
+		return
+	}
+	wait, err := timerange.ParseDuration(waitStr)
+	if err != nil {
+		return
+	}
+	if wait > yh.YDLS.Config.Prepare.maxWait {
+		wait = yh.YDLS.Config.Prepare.maxWait
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-j.doneCh:
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+func writePrepareStatus(w http.ResponseWriter, j *prepareJob) {
+	ps := prepareStatus{
+		ID:        j.id,
+		Status:    prepareStatusPreparing,
+		StatusURL: "/prepared/" + j.id,
+	}
+	statusCode := http.StatusAccepted
+
+	if j.isDone() {
+		// safe to read err without lock once done
+		if j.err != nil {
+			ps.Status = prepareStatusFailed
+			ps.Error = j.err.Error()
+			statusCode = downloadErrorStatus(j.err)
+		} else {
+			ps.Status = prepareStatusReady
+			ps.MediaURL = ps.StatusURL + "/media"
+			ps.Filename = j.filename
+			statusCode = http.StatusOK
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(ps)
+}
+
+// /prepare/format+opts.../url or /prepare?url=url&format=format&wait=duration
+func (yh *Handler) servePrepare(w http.ResponseWriter, r *http.Request, path string, infoLog *log.Logger, debugLog *log.Logger) {
+	u := *r.URL
+	u.Path = path
+	downloadOptions, ok := yh.requestDownloadOptions(w, r, &u, infoLog)
+	if !ok {
+		return
+	}
+
+	j, err := yh.prepareCache().start(downloadOptions, debugLog)
+	if err != nil {
+		infoLog.Printf("%s Prepare failed %s %s (%s)", r.RemoteAddr, r.Method, r.URL.Path, err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	infoLog.Printf("%s Preparing %s (%s) %s", r.RemoteAddr, j.id, firstNonEmpty(downloadOptions.Format, "best"), downloadOptions.URL)
+
+	// wait only makes sense for query form, path form query belongs to download URL
+	if r.URL.Query().Get("url") != "" {
+		yh.waitPrepareJob(r, j)
+	}
+
+	writePrepareStatus(w, j)
+}
+
+// /prepared/id[?wait=duration] or /prepared/id/media
+func (yh *Handler) servePrepared(w http.ResponseWriter, r *http.Request, path string, infoLog *log.Logger) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) > 2 || len(parts) == 2 && parts[1] != "media" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	j, ok := yh.prepareCache().get(parts[0])
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 1 {
+		yh.waitPrepareJob(r, j)
+		writePrepareStatus(w, j)
+		return
+	}
+
+	if !j.isDone() || j.err != nil {
+		http.Error(w, "Not ready", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		// purged while request was in progress
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	infoLog.Printf("%s Serving prepared %s", r.RemoteAddr, j.id)
+
+	setMediaHeaders(w, j.filename, j.mimeType)
+	http.ServeContent(w, r, "", j.doneAt, f)
+}
@@ -0,0 +1,271 @@
+package ydls
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wader/ydls/internal/leaktest"
+)
+
+func TestTrimPathPrefix(t *testing.T) {
+	for _, c := range []struct {
+		path     string
+		expected string
+		ok       bool
+	}{
+		{"/prepare", "/", true},
+		{"/prepare/", "/", true},
+		{"/prepare/mp3/http://a", "/mp3/http://a", true},
+		{"/prepared/id", "", false},
+		{"/mp3/http://a", "", false},
+	} {
+		actual, ok := trimPathPrefix(c.path, "/prepare")
+		if actual != c.expected || ok != c.ok {
+			t.Errorf("%s, got %s %v expected %s %v", c.path, actual, ok, c.expected, c.ok)
+		}
+	}
+}
+
+func prepareTestHandler(t *testing.T, download func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error)) *Handler {
+	h := ydlsHandlerFromEnv(t)
+	h.YDLS.Config.Prepare = PrepareConfig{ttl: time.Hour, maxWait: time.Second, timeout: time.Hour, MaxJobs: 2}
+	h.prepareCache().download = download
+
+	return h
+}
+
+func prepareTestGet(t *testing.T, h *Handler, target string) (*http.Response, prepareStatus) {
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+	resp := rr.Result()
+
+	var ps prepareStatus
+	if resp.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(resp.Body).Decode(&ps); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return resp, ps
+}
+
+func TestPrepare(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	data := []byte("media data")
+	releaseCh := make(chan struct{})
+	downloads := 0
+	h := prepareTestHandler(t, func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error) {
+		downloads++
+		<-releaseCh
+		waitCh := make(chan struct{})
+		close(waitCh)
+		return DownloadResult{
+			Media:    ioutil.NopCloser(bytes.NewReader(data)),
+			Filename: "title.mp3",
+			MIMEType: "audio/mpeg",
+			waitCh:   waitCh,
+		}, nil
+	})
+
+	resp, ps := prepareTestGet(t, h, "http://hostname/prepare/mp3/http://domain.com/path?query")
+	if resp.StatusCode != http.StatusAccepted || ps.Status != prepareStatusPreparing {
+		t.Fatalf("expected accepted preparing, got %d %+v", resp.StatusCode, ps)
+	}
+
+	// same options shares job
+	_, ps2 := prepareTestGet(t, h, "http://hostname/prepare?format=mp3&url=http://domain.com/path%3Fquery")
+	if ps2.ID != ps.ID {
+		t.Errorf("expected same id, got %s and %s", ps.ID, ps2.ID)
+	}
+
+	if resp, _ := prepareTestGet(t, h, "http://hostname"+ps.StatusURL+"/media"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found before ready, got %d", resp.StatusCode)
+	}
+
+	close(releaseCh)
+	resp, ps = prepareTestGet(t, h, "http://hostname"+ps.StatusURL+"?wait=10s")
+	if resp.StatusCode != http.StatusOK || ps.Status != prepareStatusReady || ps.Filename != "title.mp3" {
+		t.Fatalf("expected ok ready, got %d %+v", resp.StatusCode, ps)
+	}
+	if downloads != 1 {
+		t.Errorf("expected one download, got %d", downloads)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://hostname"+ps.MediaURL, nil)
+	req.Header.Set("Range", "bytes=6-")
+	h.ServeHTTP(rr, req)
+	resp = rr.Result()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "data" {
+		t.Errorf("expected partial content data, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Content-Type") != "audio/mpeg" || resp.Header.Get("Content-Disposition") == "" {
+		t.Errorf("expected media headers, got %v", resp.Header)
+	}
+
+	if resp, _ := prepareTestGet(t, h, "http://hostname/prepared/nope"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found for unknown id, got %d", resp.StatusCode)
+	}
+
+	// expire job, should remove prepared file
+	h.prepare.ttl = -1
+	if resp, _ := prepareTestGet(t, h, "http://hostname"+ps.StatusURL); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found for expired id, got %d", resp.StatusCode)
+	}
+}
+
+func TestPrepareFailed(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	downloads := 0
+	h := prepareTestHandler(t, func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error) {
+		downloads++
+		return DownloadResult{}, errors.New("test error")
+	})
+
+	resp, ps := prepareTestGet(t, h, "http://hostname/prepare?format=mp3&url=http://domain.com&wait=10s")
+	if resp.StatusCode != http.StatusBadRequest || ps.Status != prepareStatusFailed || ps.Error != "test error" {
+		t.Errorf("expected failed, got %d %+v", resp.StatusCode, ps)
+	}
+
+	// status still shows failure
+	if resp, ps := prepareTestGet(t, h, "http://hostname"+ps.StatusURL); ps.Status != prepareStatusFailed {
+		t.Errorf("expected failed status, got %d %+v", resp.StatusCode, ps)
+	}
+
+	// prepare again retries
+	prepareTestGet(t, h, "http://hostname/prepare?format=mp3&url=http://domain.com&wait=10s")
+	if downloads != 2 {
+		t.Errorf("expected retry download, got %d downloads", downloads)
+	}
+}
+
+func testMediaDownload(data []byte) func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error) {
+	return func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error) {
+		waitCh := make(chan struct{})
+		close(waitCh)
+		return DownloadResult{
+			Media:  ioutil.NopCloser(bytes.NewReader(data)),
+			waitCh: waitCh,
+		}, nil
+	}
+}
+
+func TestPrepareMaxSize(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	h := prepareTestHandler(t, testMediaDownload([]byte("0123456789")))
+	h.prepareCache().maxSize = 5
+
+	resp, ps := prepareTestGet(t, h, "http://hostname/prepare?format=mp3&url=http://domain.com&wait=10s")
+	if ps.Status != prepareStatusFailed {
+		t.Errorf("expected failed, got %d %+v", resp.StatusCode, ps)
+	}
+}
+
+func TestPrepareMaxJobs(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	releaseCh := make(chan struct{})
+	h := prepareTestHandler(t, func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error) {
+		<-releaseCh
+		return DownloadResult{}, errors.New("test error")
+	})
+
+	for i, expected := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusServiceUnavailable} {
+		resp, _ := prepareTestGet(t, h, fmt.Sprintf("http://hostname/prepare/mp3/http://domain.com/%d", i))
+		if resp.StatusCode != expected {
+			t.Errorf("%d: expected %d, got %d", i, expected, resp.StatusCode)
+		}
+	}
+
+	// running jobs count as active downloads
+	for i := 0; atomic.LoadInt32(&h.activeDownloads) != 2; i++ {
+		if i == 100 {
+			t.Fatalf("expected 2 active downloads, got %d", atomic.LoadInt32(&h.activeDownloads))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(releaseCh)
+	for _, j := range h.prepare.jobs {
+		<-j.doneCh
+	}
+	if n := atomic.LoadInt32(&h.activeDownloads); n != 0 {
+		t.Errorf("expected no active downloads, got %d", n)
+	}
+}
+
+func TestPrepareAbandoned(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	h := prepareTestHandler(t, func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error) {
+		<-ctx.Done()
+		return DownloadResult{}, ctx.Err()
+	})
+
+	_, ps := prepareTestGet(t, h, "http://hostname/prepare/mp3/http://domain.com")
+	j := h.prepare.jobs[ps.ID]
+
+	// not polled within ttl, should be canceled and removed
+	h.prepare.mutex.Lock()
+	h.prepare.ttl = -1
+	h.prepare.mutex.Unlock()
+	if resp, _ := prepareTestGet(t, h, "http://hostname"+ps.StatusURL); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", resp.StatusCode)
+	}
+	<-j.doneCh
+}
+
+func TestPrepareRemovedWhileRunning(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	releaseCh := make(chan struct{})
+	h := prepareTestHandler(t, func(ctx context.Context, options DownloadOptions, debugLog *log.Logger) (DownloadResult, error) {
+		// ignores context as if removed after run checked it
+		<-releaseCh
+		waitCh := make(chan struct{})
+		close(waitCh)
+		return DownloadResult{
+			Media:  ioutil.NopCloser(bytes.NewReader([]byte("media data"))),
+			waitCh: waitCh,
+		}, nil
+	})
+
+	_, ps := prepareTestGet(t, h, "http://hostname/prepare/mp3/http://domain.com")
+	h.prepare.mutex.Lock()
+	j := h.prepare.jobs[ps.ID]
+	delete(h.prepare.jobs, ps.ID)
+	h.prepare.mutex.Unlock()
+
+	close(releaseCh)
+	<-j.doneCh
+	if j.err == nil {
+		t.Error("expected removed job to fail")
+	}
+	if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+		t.Errorf("expected prepared file to be removed, got %v", err)
+	}
+}
+
+func TestPrepareDisabled(t *testing.T) {
+	h := ydlsHandlerFromEnv(t)
+
+	resp, _ := prepareTestGet(t, h, "http://hostname/prepare/mp3/http://domain.com")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected not found, got %d", resp.StatusCode)
+	}
+}
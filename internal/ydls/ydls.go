@@ -11,7 +11,9 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/wader/ydls/internal/denylist"
 	"github.com/wader/ydls/internal/ffmpeg"
 	"github.com/wader/ydls/internal/id3v2"
 	"github.com/wader/ydls/internal/rereader"
@@ -242,6 +244,21 @@ func downloadAndProbeFormat(
 // YDLS youtubedl downloader with some extras
 type YDLS struct {
 	Config Config
+
+	denylist *denylist.Denylist
+}
+
+func newDenylistFromConfig(c ComplianceConfig) (*denylist.Denylist, error) {
+	if c.Denylist == "" {
+		return nil, nil
+	}
+
+	dl, err := denylist.New(c.Denylist, c.Country, c.refreshInterval, log.New(os.Stderr, "", log.LstdFlags))
+	if err != nil {
+		return nil, fmt.Errorf("compliance denylist: %s", err)
+	}
+
+	return dl, nil
 }
 
 // NewFromFile new YDLs using config file
@@ -255,8 +272,28 @@ func NewFromFile(configPath string) (YDLS, error) {
 	if err != nil {
 		return YDLS{}, err
 	}
+	dl, err := newDenylistFromConfig(config.Compliance)
+	if err != nil {
+		return YDLS{}, err
+	}
 
-	return YDLS{Config: config}, nil
+	return YDLS{Config: config, denylist: dl}, nil
+}
+
+// Close stops background work like compliance denylist reload
+func (ydls *YDLS) Close() {
+	if ydls.denylist != nil {
+		ydls.denylist.Close()
+	}
+}
+
+// checkURL returns denylist.Error if URL is blocked by compliance denylist
+func (ydls *YDLS) checkURL(rawURL string) error {
+	if ydls.denylist == nil {
+		return nil
+	}
+
+	return ydls.denylist.CheckURL(rawURL)
 }
 
 // DownloadOptions download options
@@ -266,6 +303,7 @@ type DownloadOptions struct {
 	Codecs      []string            // force codecs
 	Retranscode bool                // force retranscode even if same input codec
 	TimeRange   timerange.TimeRange // time range limit
+	Filter      Filter              // upload date and duration constraints
 }
 
 // DownloadResult download result
@@ -273,6 +311,7 @@ type DownloadResult struct {
 	Media    io.ReadCloser
 	Filename string
 	MIMEType string
+	Duration time.Duration // source or time range duration, zero if unknown
 	waitCh   chan struct{}
 }
 
@@ -310,20 +349,32 @@ func chooseCodec(formatCodecs []Codec, optionCodecs []string, probedCodecs []str
 // ParseDownloadOptions parse options based on curret config
 func (ydls *YDLS) ParseDownloadOptions(url string, formatName string, optStrings []string) (DownloadOptions, error) {
 	if formatName == "" {
-		return DownloadOptions{
+		opts := DownloadOptions{
 			URL:    url,
 			Format: "",
-		}, nil
+		}
+		// only filter options makes sense without format
+		for _, opt := range optStrings {
+			if _, err := opts.Filter.parseOpt(opt); err != nil {
+				return DownloadOptions{}, err
+			}
+		}
+
+		return opts, nil
 	}
 
-	format, formatFound := ydls.Config.Formats.FindByName(formatName)
+	configFormatName, formatFound := ydls.Config.Formats.FindName(formatName)
 	if !formatFound {
-		return DownloadOptions{}, fmt.Errorf("unknown format %s", formatName)
+		return DownloadOptions{}, UnknownFormatError{
+			Name:        formatName,
+			Suggestions: ydls.Config.Formats.Suggest(formatName),
+		}
 	}
+	format := ydls.Config.Formats[configFormatName]
 
 	opts := DownloadOptions{
 		URL:    url,
-		Format: formatName,
+		Format: configFormatName,
 	}
 
 	codecNames := map[string]bool{}
@@ -340,6 +391,10 @@ func (ydls *YDLS) ParseDownloadOptions(url string, formatName string, optStrings
 			opts.Codecs = append(opts.Codecs, opt)
 		} else if tr, trErr := timerange.NewFromString(opt); trErr == nil {
 			opts.TimeRange = tr
+		} else if ok, filterErr := opts.Filter.parseOpt(opt); ok {
+			if filterErr != nil {
+				return DownloadOptions{}, filterErr
+			}
 		} else {
 			return DownloadOptions{}, fmt.Errorf("unknown opt %s", opt)
 		}
@@ -368,6 +423,11 @@ func (ydls *YDLS) Download(ctx context.Context, options DownloadOptions, debugLo
 	log.Printf("URL: %s", options.URL)
 	log.Printf("Output format: %s", options.Format)
 
+	if err := ydls.checkURL(options.URL); err != nil {
+		log.Printf("Blocked: %s", err)
+		return DownloadResult{}, err
+	}
+
 	ydlStdout := writelogger.New(log, "ydl-info stdout> ")
 	ydl, err := youtubedl.NewFromURL(ctx, options.URL, ydlStdout)
 	if err != nil {
@@ -375,17 +435,48 @@ func (ydls *YDLS) Download(ctx context.Context, options DownloadOptions, debugLo
 		return DownloadResult{}, err
 	}
 
+	// check resolved info too as short links, redirects and embeds can hide blocked sites
+	if ydls.denylist != nil {
+		for _, err := range []error{
+			ydls.denylist.CheckURL(ydl.WebpageURL),
+			ydls.denylist.CheckExtractor(ydl.Extractor),
+			ydls.denylist.CheckID(ydl.Extractor, ydl.ID),
+		} {
+			if err != nil {
+				log.Printf("Blocked: %s", err)
+				return DownloadResult{}, err
+			}
+		}
+	}
+
 	log.Printf("Title: %s", ydl.Title)
+
+	if err := options.Filter.Match(ydl); err != nil {
+		log.Printf("Filtered: %s", err)
+		return DownloadResult{}, err
+	}
+
 	log.Printf("Available youtubedl formats:")
 	for _, f := range ydl.Formats {
 		log.Printf("  %s", f)
 	}
 
+	var dr DownloadResult
 	if options.Format == "" {
-		return ydls.downloadRaw(ctx, log, ydl)
+		dr, err = ydls.downloadRaw(ctx, log, ydl)
+	} else {
+		dr, err = ydls.downloadFormat(ctx, log, options, ydl)
+	}
+	if err != nil {
+		return DownloadResult{}, err
 	}
 
-	return ydls.downloadFormat(ctx, log, options, ydl)
+	dr.Duration = time.Duration(ydl.Duration * float64(time.Second))
+	if !options.TimeRange.IsZero() && (dr.Duration == 0 || options.TimeRange.Duration() < dr.Duration) {
+		dr.Duration = options.TimeRange.Duration()
+	}
+
+	return dr, nil
 }
 
 func (ydls *YDLS) downloadRaw(ctx context.Context, log *log.Logger, ydl youtubedl.Info) (DownloadResult, error) {
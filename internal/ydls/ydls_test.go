@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/wader/ydls/internal/denylist"
 	"github.com/wader/ydls/internal/ffmpeg"
 	"github.com/wader/ydls/internal/leaktest"
 	"github.com/wader/ydls/internal/stringprioset"
@@ -45,6 +46,34 @@ func ydlsFromEnv(t *testing.T) YDLS {
 	return ydls
 }
 
+// testDenylist denylist with entries, file is removed as entries are loaded by New
+func testDenylist(t *testing.T, refreshInterval time.Duration, entries string) *denylist.Denylist {
+	f, err := ioutil.TempFile("", "ydls-denylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(entries)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dl, err := newDenylistFromConfig(ComplianceConfig{Denylist: f.Name(), refreshInterval: refreshInterval})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dl
+}
+
+func TestCloseStopsDenylistReload(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	ydls := YDLS{denylist: testDenylist(t, time.Hour, "domain example.com\n")}
+	ydls.Close()
+}
+
 func TestSafeFilename(t *testing.T) {
 	for _, c := range []struct {
 		s      string
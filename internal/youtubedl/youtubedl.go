@@ -22,6 +22,10 @@ func (e Error) Error() string {
 
 // Info youtubedl json, thumbnail bytes and raw JSON
 type Info struct {
+	ID         string `json:"id"`
+	WebpageURL string `json:"webpage_url"`
+	Extractor  string `json:"extractor"`
+
 	Artist   string `json:"artist"`
 	Uploader string `json:"uploader"`
 	Creator  string `json:"creator"`
@@ -29,6 +33,7 @@ type Info struct {
 	Title       string   `json:"title"`
 	Description string   `json:"description"`
 	Duration    float64  `json:"duration"`
+	UploadDate  string   `json:"upload_date"`
 	Thumbnail   string   `json:"thumbnail"`
 	Formats     []Format `json:"formats"`
 